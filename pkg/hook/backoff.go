@@ -0,0 +1,166 @@
+/*
+Copyright 2021 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hook
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Stop is returned by BackOff.NextBackOff when no more retries should be
+// attempted.
+const Stop time.Duration = -1
+
+// BackOff is a pluggable retry policy for HookRunner.  It is modeled on
+// github.com/cenkalti/backoff/v4's BackOff interface so that callers already
+// familiar with that package feel at home, without taking on the dependency.
+type BackOff interface {
+	// NextBackOff returns the duration to wait before the next retry, or
+	// Stop if the caller should give up.
+	NextBackOff() time.Duration
+	// Reset returns the BackOff to its initial state, as if no attempts had
+	// been made yet.
+	Reset()
+}
+
+// MaxIntervalBackOff is implemented by a BackOff policy that can report a
+// ceiling on any single wait.  HookRunner consults it when a Hook suggests a
+// longer-than-usual delay (e.g. via RetryableError.RetryAfter), so a
+// server-suggested delay can lengthen the wait without letting a slow or
+// malicious one stall the runner indefinitely.
+type MaxIntervalBackOff interface {
+	BackOff
+	// MaxWait returns the longest interval this policy will ever wait
+	// between attempts.  Zero means unbounded.
+	MaxWait() time.Duration
+}
+
+// Clock is the subset of time's functionality that ExponentialBackOff needs.
+// It exists so that tests can inject a fake clock instead of sleeping in real
+// time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Default tuning, matching cenkalti/backoff/v4's defaults.
+const (
+	DefaultInitialInterval     = 500 * time.Millisecond
+	DefaultRandomizationFactor = 0.5
+	DefaultMultiplier          = 1.5
+	DefaultMaxInterval         = 60 * time.Second
+)
+
+// ExponentialBackOff is the default BackOff implementation.  It increases the
+// retry interval exponentially (with jitter), up to MaxInterval, and gives up
+// once MaxElapsedTime or MaxAttempts is exceeded.  A zero value for
+// MaxElapsedTime or MaxAttempts means "no limit", matching
+// cenkalti/backoff/v4 semantics for MaxElapsedTime.
+type ExponentialBackOff struct {
+	InitialInterval     time.Duration
+	RandomizationFactor float64
+	Multiplier          float64
+	MaxInterval         time.Duration
+	// MaxElapsedTime bounds the total time spent retrying since the last
+	// Reset.  Zero means no limit.
+	MaxElapsedTime time.Duration
+	// MaxAttempts bounds the number of calls to NextBackOff since the last
+	// Reset.  Zero means no limit.
+	MaxAttempts int
+
+	// Clock is used to measure elapsed time; defaults to the real clock.
+	Clock Clock
+
+	currentInterval time.Duration
+	startTime       time.Time
+	attempts        int
+}
+
+// NewExponentialBackOff returns an ExponentialBackOff configured with the
+// package defaults and no cap on elapsed time or attempts.
+func NewExponentialBackOff() *ExponentialBackOff {
+	b := &ExponentialBackOff{
+		InitialInterval:     DefaultInitialInterval,
+		RandomizationFactor: DefaultRandomizationFactor,
+		Multiplier:          DefaultMultiplier,
+		MaxInterval:         DefaultMaxInterval,
+		Clock:               realClock{},
+	}
+	b.Reset()
+	return b
+}
+
+func (b *ExponentialBackOff) clock() Clock {
+	if b.Clock == nil {
+		return realClock{}
+	}
+	return b.Clock
+}
+
+// Reset returns the BackOff to its initial interval and clears the elapsed
+// time and attempt counters.
+func (b *ExponentialBackOff) Reset() {
+	b.currentInterval = b.InitialInterval
+	b.startTime = b.clock().Now()
+	b.attempts = 0
+}
+
+// MaxWait implements MaxIntervalBackOff.
+func (b *ExponentialBackOff) MaxWait() time.Duration {
+	return b.MaxInterval
+}
+
+// NextBackOff returns the next interval to wait, or Stop if MaxElapsedTime or
+// MaxAttempts has been exceeded.
+func (b *ExponentialBackOff) NextBackOff() time.Duration {
+	b.attempts++
+	if b.MaxAttempts > 0 && b.attempts > b.MaxAttempts {
+		return Stop
+	}
+	if b.MaxElapsedTime > 0 && b.clock().Now().Sub(b.startTime) > b.MaxElapsedTime {
+		return Stop
+	}
+
+	next := randomize(b.currentInterval, b.RandomizationFactor)
+	b.incrementInterval()
+	return next
+}
+
+func (b *ExponentialBackOff) incrementInterval() {
+	if b.currentInterval >= b.MaxInterval {
+		b.currentInterval = b.MaxInterval
+		return
+	}
+	b.currentInterval = time.Duration(float64(b.currentInterval) * b.Multiplier)
+	if b.currentInterval > b.MaxInterval {
+		b.currentInterval = b.MaxInterval
+	}
+}
+
+// randomize returns interval +/- (randomizationFactor * interval).
+func randomize(interval time.Duration, randomizationFactor float64) time.Duration {
+	if randomizationFactor <= 0 {
+		return interval
+	}
+	delta := randomizationFactor * float64(interval)
+	min := float64(interval) - delta
+	max := float64(interval) + delta
+	return time.Duration(min + (rand.Float64() * (max - min + 1)))
+}
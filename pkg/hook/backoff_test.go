@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hook
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is an injectable Clock for deterministic tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestExponentialBackOffIncreasesAndCaps(t *testing.T) {
+	b := &ExponentialBackOff{
+		InitialInterval:     time.Second,
+		RandomizationFactor: 0, // deterministic
+		Multiplier:          2,
+		MaxInterval:         8 * time.Second,
+		Clock:               &fakeClock{now: time.Unix(0, 0)},
+	}
+	b.Reset()
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for i, w := range want {
+		got := b.NextBackOff()
+		if got != w {
+			t.Errorf("attempt %d: got %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestExponentialBackOffMaxAttempts(t *testing.T) {
+	b := &ExponentialBackOff{
+		InitialInterval:     time.Second,
+		RandomizationFactor: 0,
+		Multiplier:          2,
+		MaxInterval:         time.Minute,
+		MaxAttempts:         2,
+		Clock:               &fakeClock{now: time.Unix(0, 0)},
+	}
+	b.Reset()
+
+	if got := b.NextBackOff(); got == Stop {
+		t.Fatalf("attempt 1: got Stop, want a real interval")
+	}
+	if got := b.NextBackOff(); got == Stop {
+		t.Fatalf("attempt 2: got Stop, want a real interval")
+	}
+	if got := b.NextBackOff(); got != Stop {
+		t.Errorf("attempt 3: got %v, want Stop", got)
+	}
+}
+
+func TestExponentialBackOffMaxElapsedTime(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	b := &ExponentialBackOff{
+		InitialInterval:     time.Second,
+		RandomizationFactor: 0,
+		Multiplier:          2,
+		MaxInterval:         time.Minute,
+		MaxElapsedTime:      5 * time.Second,
+		Clock:               clock,
+	}
+	b.Reset()
+
+	if got := b.NextBackOff(); got == Stop {
+		t.Fatalf("got Stop before MaxElapsedTime was exceeded")
+	}
+
+	clock.Advance(10 * time.Second)
+	if got := b.NextBackOff(); got != Stop {
+		t.Errorf("got %v, want Stop after MaxElapsedTime exceeded", got)
+	}
+}
+
+func TestExponentialBackOffReset(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	b := &ExponentialBackOff{
+		InitialInterval:     time.Second,
+		RandomizationFactor: 0,
+		Multiplier:          2,
+		MaxInterval:         time.Minute,
+		MaxAttempts:         1,
+		Clock:               clock,
+	}
+	b.Reset()
+
+	if got := b.NextBackOff(); got != time.Second {
+		t.Fatalf("got %v, want %v", got, time.Second)
+	}
+	if got := b.NextBackOff(); got != Stop {
+		t.Fatalf("got %v, want Stop", got)
+	}
+
+	b.Reset()
+	if got := b.NextBackOff(); got != time.Second {
+		t.Errorf("after Reset: got %v, want %v", got, time.Second)
+	}
+}
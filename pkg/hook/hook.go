@@ -18,6 +18,7 @@ package hook
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"runtime"
 	"sync"
@@ -32,8 +33,32 @@ var (
 		Name: "git_sync_hook_run_count_total",
 		Help: "How many hook runs completed, partitioned by name and state (success, error)",
 	}, []string{"name", "status"})
+
+	hookGiveupCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_hook_giveup_total",
+		Help: "How many times a hook's run was abandoned for a hash, either because its backoff policy was exhausted or because it returned a non-retryable error, partitioned by name",
+	}, []string{"name"})
+
+	hookQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_sync_hook_queue_depth",
+		Help: "Number of hashes currently queued for delivery, partitioned by name (EveryHash delivery mode only)",
+	}, []string{"name"})
+
+	hookQueueDroppedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_hook_queue_dropped_total",
+		Help: "How many hashes were dropped because the delivery queue was full, partitioned by name (EveryHash delivery mode only)",
+	}, []string{"name"})
+
+	// registerHookMetricsOnce guards prometheus registration so that running
+	// multiple HookRunners (e.g. via HookManager) in one process doesn't
+	// attempt to register the same collectors twice.
+	registerHookMetricsOnce sync.Once
 )
 
+func registerHookMetrics() {
+	prometheus.MustRegister(hookRunCount, hookGiveupCount, hookLastSuccessTimestamp, hookQueueDepth, hookQueueDroppedCount)
+}
+
 // Describes what a Hook needs to implement, run by HookRunner
 type Hook interface {
 	// Describes hook
@@ -42,17 +67,79 @@ type Hook interface {
 	Do(ctx context.Context, hash string) error
 }
 
+// RetryableError wraps a Do failure that is worth retrying via the backoff
+// policy (e.g. a 5xx from a webhook, or a transient network error).  A Hook
+// that can tell a transient failure apart from a permanent one should wrap
+// only the transient ones in RetryableError; HookRunner treats any other
+// error as terminal and gives up on the current hash immediately rather than
+// burning through the full backoff cycle.
+type RetryableError struct {
+	Err error
+	// RetryAfter is an optional hint for how long to wait before the next
+	// attempt (e.g. parsed from an HTTP Retry-After header).  Zero means no
+	// hint, and the backoff policy's own interval is used unchanged.  A
+	// non-zero hint only ever lengthens the wait HookRunner would otherwise
+	// use, and is still capped at a MaxIntervalBackOff's MaxWait if the
+	// configured BackOff implements it, so a slow or malicious server can't
+	// stall the runner past that ceiling.
+	RetryAfter time.Duration
+}
+
+func (e *RetryableError) Error() string { return e.Err.Error() }
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+// DeliveryMode selects how a hookData hands hashes from producer (Send) to
+// consumer (HookRunner.Run).
+type DeliveryMode int
+
+const (
+	// Coalesce is the default: send overwrites the pending hash and wakes
+	// the consumer with a non-blocking write to a size-1 channel, so
+	// hashes that arrive while the consumer is busy may be skipped in
+	// favor of the newest one.
+	Coalesce DeliveryMode = iota
+	// EveryHash guarantees the consumer observes every hash sent, backed by
+	// a bounded FIFO queue.  If the queue is full, new hashes are dropped
+	// (and counted via git_sync_hook_queue_dropped_total) rather than
+	// blocking the producer.
+	EveryHash
+)
+
+// DefaultQueueCapacity is used in EveryHash mode when NewHookData is given a
+// non-positive capacity.
+const DefaultQueueCapacity = 64
+
 type hookData struct {
+	// name labels the EveryHash-mode queue metrics; typically the owning
+	// Hook's Name().
+	name string
+	mode DeliveryMode
+
+	// Coalesce mode.
 	ch    chan struct{}
 	mutex sync.Mutex
 	hash  string
+
+	// EveryHash mode.
+	queue chan string
 }
 
-// NewHookData returns a new HookData
-func NewHookData() *hookData {
-	return &hookData{
-		ch: make(chan struct{}, 1),
+// NewHookData returns a new hookData.  name labels the EveryHash-mode queue
+// metrics (git_sync_hook_queue_depth, git_sync_hook_queue_dropped_total) and
+// is typically the owning Hook's Name().  capacity is only meaningful in
+// EveryHash mode, where a non-positive value is replaced with
+// DefaultQueueCapacity; it is ignored in Coalesce mode.
+func NewHookData(name string, mode DeliveryMode, capacity int) *hookData {
+	d := &hookData{name: name, mode: mode}
+	if mode == EveryHash {
+		if capacity <= 0 {
+			capacity = DefaultQueueCapacity
+		}
+		d.queue = make(chan string, capacity)
+	} else {
+		d.ch = make(chan struct{}, 1)
 	}
+	return d
 }
 
 func (d *hookData) events() chan struct{} {
@@ -72,6 +159,11 @@ func (d *hookData) set(newHash string) {
 }
 
 func (d *hookData) send(newHash string) {
+	if d.mode == EveryHash {
+		d.enqueue(newHash)
+		return
+	}
+
 	d.set(newHash)
 
 	// Non-blocking write.  If the channel is full, the consumer will see the
@@ -83,17 +175,40 @@ func (d *hookData) send(newHash string) {
 	}
 }
 
-// NewHookRunner returns a new HookRunner
-func NewHookRunner(hook Hook, backoff time.Duration, data *hookData, log *logging.Logger, hasSucceededOnce chan bool) *HookRunner {
-	return &HookRunner{hook: hook, backoff: backoff, data: data, logger: log, hasCompletedOnce: hasSucceededOnce}
+// enqueue pushes hash onto the bounded FIFO without blocking the producer.
+// If the queue is full, the hash is dropped and counted rather than
+// overwriting anything already queued.
+func (d *hookData) enqueue(hash string) {
+	select {
+	case d.queue <- hash:
+		hookQueueDepth.WithLabelValues(d.name).Set(float64(len(d.queue)))
+	default:
+		hookQueueDroppedCount.WithLabelValues(d.name).Inc()
+	}
+}
+
+// NewHookRunner returns a new HookRunner.  backoff controls how failed hook
+// runs are retried; if nil, a default ExponentialBackOff with no cap on
+// elapsed time or attempts is used (matching the old fixed-sleep behavior,
+// but with jitter).  timeout, if positive, bounds each individual call to
+// hook.Do; a hook that blocks past timeout has its context canceled and the
+// call is counted as a failed (timeout) run, not left to block the runner
+// forever.
+func NewHookRunner(hook Hook, backoff BackOff, data *hookData, log *logging.Logger, hasSucceededOnce chan bool, timeout time.Duration) *HookRunner {
+	if backoff == nil {
+		backoff = NewExponentialBackOff()
+	}
+	return &HookRunner{hook: hook, backoff: backoff, data: data, logger: log, hasCompletedOnce: hasSucceededOnce, timeout: timeout}
 }
 
 // HookRunner struct
 type HookRunner struct {
 	// Hook to run and check
 	hook Hook
-	// Backoff for failed hooks
-	backoff time.Duration
+	// Backoff policy for failed hooks.  Exhausting it (NextBackOff
+	// returning Stop) abandons the current hash rather than retrying
+	// forever.
+	backoff BackOff
 	// Holds the data as it crosses from producer to consumer.
 	data *hookData
 	// Logger
@@ -103,6 +218,16 @@ type HookRunner struct {
 	// initialised to a buffered channel of size 1.
 	// Is only meant for use within sendCompletedOnceMessageIfApplicable.
 	hasCompletedOnce chan bool
+	// Timeout bounds each individual call to hook.Do.  Zero (the default)
+	// means no per-call timeout beyond whatever ctx passed to Run already
+	// imposes.
+	timeout time.Duration
+	// retryAfterHint carries the most recent RetryableError.RetryAfter
+	// through to the next backOffOrGiveUp call.  A HookRunner is only ever
+	// driven by its own single Run goroutine, so this needs no
+	// synchronization of its own (see gatedHook.lastParentVersion for the
+	// same reasoning).
+	retryAfterHint time.Duration
 }
 
 // Send sends hash to hookdata
@@ -110,39 +235,208 @@ func (r *HookRunner) Send(hash string) {
 	r.data.send(hash)
 }
 
-// Run waits for trigger events from the channel, and run hook when triggered
+// Run waits for trigger events from the channel, and run hook when triggered.
+// In Coalesce mode (the default), it always retries with the newest hash, so
+// hashes sent in quick succession may not all be observed.  In EveryHash
+// mode, it iterates the queued hashes one at a time, guaranteeing each is
+// observed, at the cost of potentially lagging behind the newest hash.
 func (r *HookRunner) Run(ctx context.Context) {
+	registerHookMetricsOnce.Do(registerHookMetrics)
+
+	if r.data.mode == EveryHash {
+		r.runEveryHash(ctx)
+		return
+	}
+	r.runCoalesce(ctx)
+}
+
+func (r *HookRunner) runCoalesce(ctx context.Context) {
 	var lastHash string
-	prometheus.MustRegister(hookRunCount)
 
 	// Wait for trigger from hookData.Send
 	for range r.data.events() {
-		// Retry in case of error
+		r.backoff.Reset()
+
+		var attemptedHash string
+		haveAttempted := false
 		for {
 			// Always get the latest value, in case we fail-and-retry and the
-			// value changed in the meantime.  This means that we might not send
-			// every single hash.
+			// value changed in the meantime.  This means that we might not
+			// send every single hash.  This fast path only applies in
+			// Coalesce mode; EveryHash mode must run every queued hash.
 			hash := r.data.get()
 			if hash == lastHash {
 				break
 			}
 
-			if err := r.hook.Do(ctx, hash); err != nil {
-				r.logger.Error(err, "hook failed")
-				updateHookRunCountMetric(r.hook.Name(), "error")
-				// don't want to sleep unnecessarily terminating anyways
-				r.sendCompletedOnceMessageIfApplicable(false)
-				time.Sleep(r.backoff)
-			} else {
-				updateHookRunCountMetric(r.hook.Name(), "success")
+			if haveAttempted && hash != attemptedHash {
+				// A newer hash coalesced in while we were backing off from a
+				// failure on the previous one; it deserves its own fresh
+				// attempt cycle rather than inheriting the previous hash's
+				// partly spent backoff budget.
+				r.backoff.Reset()
+			}
+			attemptedHash, haveAttempted = hash, true
+
+			switch r.runOnce(ctx, hash) {
+			case runSuccess:
 				lastHash = hash
-				r.sendCompletedOnceMessageIfApplicable(true)
-				break
+			case runCanceled:
+				return
+			case runTerminal:
+				r.giveUp(fmt.Errorf("hook returned a non-retryable error"))
+				lastHash = r.data.get()
+			default: // runRetryable
+				if !r.backOffOrGiveUp() {
+					continue
+				}
+				lastHash = r.data.get()
 			}
+			break
 		}
 	}
 }
 
+func (r *HookRunner) runEveryHash(ctx context.Context) {
+	for hash := range r.data.queue {
+		hookQueueDepth.WithLabelValues(r.data.name).Set(float64(len(r.data.queue)))
+		r.backoff.Reset()
+		for {
+			switch r.runOnce(ctx, hash) {
+			case runSuccess:
+			case runCanceled:
+				return
+			case runTerminal:
+				r.giveUp(fmt.Errorf("hook returned a non-retryable error"))
+			default: // runRetryable
+				if !r.backOffOrGiveUp() {
+					continue
+				}
+			}
+			break
+		}
+	}
+}
+
+// runResult reports the outcome of a single runOnce call.
+type runResult int
+
+const (
+	runSuccess runResult = iota
+	// runRetryable means the hook failed in a way worth retrying via the
+	// backoff policy (a timeout, or an error satisfying errors.As against
+	// *RetryableError).
+	runRetryable
+	// runTerminal means the hook failed in a way that retrying would not
+	// help; the caller should give up on the current hash immediately.
+	runTerminal
+	// runCanceled means the call context was canceled out-of-band (e.g. the
+	// ctx passed to Run was canceled for ordinary shutdown while the hook
+	// was in flight), as opposed to the hook itself failing.  This is
+	// neither a retry candidate nor a give-up: the caller should stop
+	// attempting the current hash without logging or counting it as a
+	// hook failure.
+	runCanceled
+)
+
+// runOnce invokes the hook once for hash and reports the outcome.  If
+// r.timeout is set, the call is bounded by it; a hook that is still running
+// when the timeout elapses has its context canceled (so, e.g., an exec
+// hook's child process gets killed after its own grace period) and the run
+// is counted as a timeout, which is always treated as retryable.  An error
+// that does not satisfy errors.As against *RetryableError is treated as
+// terminal: see RetryableError.  A canceled call context is reported as
+// runCanceled rather than runTerminal, since it reflects the caller shutting
+// down, not the hook failing.
+func (r *HookRunner) runOnce(ctx context.Context, hash string) runResult {
+	callCtx := ctx
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	err := r.hook.Do(callCtx, hash)
+	if err == nil {
+		updateHookRunCountMetric(r.hook.Name(), "success")
+		updateHookLastSuccessTimestampMetric(r.hook.Name())
+		r.backoff.Reset()
+		r.retryAfterHint = 0
+		r.sendCompletedOnceMessageIfApplicable(true)
+		return runSuccess
+	}
+
+	if errors.Is(callCtx.Err(), context.Canceled) {
+		// Ordinary shutdown, not a hook failure: don't log it as one, don't
+		// count it toward giveup, and don't feed hasCompletedOnce a false
+		// result for what isn't actually a failed run.
+		return runCanceled
+	}
+
+	r.logError(err, "hook failed")
+	// don't want to sleep unnecessarily terminating anyways
+	r.sendCompletedOnceMessageIfApplicable(false)
+
+	var retryable *RetryableError
+	switch {
+	case callCtx.Err() == context.DeadlineExceeded:
+		updateHookRunCountMetric(r.hook.Name(), "timeout")
+		r.retryAfterHint = 0
+		return runRetryable
+	case errors.As(err, &retryable):
+		updateHookRunCountMetric(r.hook.Name(), "error")
+		r.retryAfterHint = retryable.RetryAfter
+		return runRetryable
+	default:
+		updateHookRunCountMetric(r.hook.Name(), "terminal")
+		return runTerminal
+	}
+}
+
+// backOffOrGiveUp sleeps for the backoff policy's next interval -- lengthened
+// to r.retryAfterHint if the most recent failure suggested a longer wait, and
+// capped at the policy's MaxWait if it implements MaxIntervalBackOff -- and
+// returns false, or gives up and returns true if the policy is exhausted.
+func (r *HookRunner) backOffOrGiveUp() bool {
+	wait := r.backoff.NextBackOff()
+	if wait == Stop {
+		r.giveUp(fmt.Errorf("retries exhausted"))
+		return true
+	}
+
+	if r.retryAfterHint > wait {
+		wait = r.retryAfterHint
+	}
+	r.retryAfterHint = 0
+	if capped, ok := r.backoff.(MaxIntervalBackOff); ok {
+		if max := capped.MaxWait(); max > 0 && wait > max {
+			wait = max
+		}
+	}
+
+	time.Sleep(wait)
+	return false
+}
+
+// giveUp logs and counts that retries for the current hash were abandoned,
+// whether because the backoff policy was exhausted or because runOnce
+// classified the failure as terminal.
+func (r *HookRunner) giveUp(reason error) {
+	r.logError(reason, "hook giving up", "name", r.hook.Name())
+	updateHookGiveupCountMetric(r.hook.Name())
+}
+
+// logError logs via r.logger if one was provided; NewHookRunner does not
+// require a logger (tests in particular often have none to hand), so this
+// keeps the zero value usable instead of nil-dereferencing on the first
+// failure.
+func (r *HookRunner) logError(err error, msg string, keysAndValues ...interface{}) {
+	if r.logger == nil {
+		return
+	}
+	r.logger.Error(err, msg, keysAndValues...)
+}
+
 // If hasCompletedOnce is nil, does nothing. Otherwise, forwards the caller
 // provided success status (as a boolean) of HookRunner to receivers of
 // hasCompletedOnce, closes said chanel, and terminates this goroutine.
@@ -178,3 +472,11 @@ func (r *HookRunner) WaitForCompletion() error {
 func updateHookRunCountMetric(name, status string) {
 	hookRunCount.WithLabelValues(name, status).Inc()
 }
+
+func updateHookGiveupCountMetric(name string) {
+	hookGiveupCount.WithLabelValues(name).Inc()
+}
+
+func updateHookLastSuccessTimestampMetric(name string) {
+	hookLastSuccessTimestamp.WithLabelValues(name).Set(float64(time.Now().Unix()))
+}
@@ -0,0 +1,438 @@
+/*
+Copyright 2021 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hook
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowRecordingHook records every hash it is asked to process, sleeping a
+// bit on each call to simulate a slow downstream hook.
+type slowRecordingHook struct {
+	name  string
+	delay time.Duration
+
+	mutex  sync.Mutex
+	hashes []string
+}
+
+func (h *slowRecordingHook) Name() string { return h.name }
+
+func (h *slowRecordingHook) Do(ctx context.Context, hash string) error {
+	time.Sleep(h.delay)
+	h.mutex.Lock()
+	h.hashes = append(h.hashes, hash)
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *slowRecordingHook) seen() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out := make([]string, len(h.hashes))
+	copy(out, h.hashes)
+	return out
+}
+
+func TestEveryHashModeObservesAllHashes(t *testing.T) {
+	hook := &slowRecordingHook{name: "slow", delay: 20 * time.Millisecond}
+	data := NewHookData("slow", EveryHash, 16)
+	runner := NewHookRunner(hook, nil, data, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.Run(ctx)
+
+	want := []string{"h1", "h2", "h3", "h4", "h5"}
+	for _, hash := range want {
+		runner.Send(hash)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		if len(hook.seen()) >= len(want) {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for all hashes; got %v", hook.seen())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	got := hook.seen()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, h := range want {
+		if got[i] != h {
+			t.Errorf("position %d: got %q, want %q", i, got[i], h)
+		}
+	}
+}
+
+func TestCoalesceModeMaySkipIntermediateHashes(t *testing.T) {
+	hook := &slowRecordingHook{name: "coalesce", delay: 50 * time.Millisecond}
+	data := NewHookData("coalesce", Coalesce, 0)
+	runner := NewHookRunner(hook, nil, data, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.Run(ctx)
+
+	runner.Send("h1")
+	time.Sleep(5 * time.Millisecond) // let the runner start on h1
+	runner.Send("h2")
+	runner.Send("h3") // coalesced: h2 is overwritten before the runner reads it
+
+	time.Sleep(200 * time.Millisecond)
+
+	got := hook.seen()
+	if len(got) == 0 || got[len(got)-1] != "h3" {
+		t.Fatalf("expected the last observed hash to be h3, got %v", got)
+	}
+	if len(got) >= 3 {
+		t.Errorf("expected coalescing to skip at least one intermediate hash, got %v", got)
+	}
+}
+
+func TestQueueDroppedWhenFull(t *testing.T) {
+	data := NewHookData("full", EveryHash, 1)
+	data.send("h1") // fills the single-slot queue
+	data.send("h2") // should be dropped
+
+	if got := len(data.queue); got != 1 {
+		t.Fatalf("queue length = %d, want 1", got)
+	}
+	if got := <-data.queue; got != "h1" {
+		t.Errorf("queued hash = %q, want h1", got)
+	}
+}
+
+// blockingUntilCtxHook records every hash it is asked to process, then
+// blocks until its context is canceled (simulating a stuck exec/webhook
+// call) and returns the context's error.
+type blockingUntilCtxHook struct {
+	name string
+
+	mutex sync.Mutex
+	calls []string
+}
+
+func (h *blockingUntilCtxHook) Name() string { return h.name }
+
+func (h *blockingUntilCtxHook) Do(ctx context.Context, hash string) error {
+	h.mutex.Lock()
+	h.calls = append(h.calls, hash)
+	h.mutex.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (h *blockingUntilCtxHook) seenCalls() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out := make([]string, len(h.calls))
+	copy(out, h.calls)
+	return out
+}
+
+// alwaysFailingHook records every hash it is called with and always fails,
+// either with a hook.RetryableError (retryable) or a plain error (terminal).
+type alwaysFailingHook struct {
+	name      string
+	retryable bool
+
+	mutex sync.Mutex
+	calls []string
+}
+
+func (h *alwaysFailingHook) Name() string { return h.name }
+
+func (h *alwaysFailingHook) Do(ctx context.Context, hash string) error {
+	h.mutex.Lock()
+	h.calls = append(h.calls, hash)
+	h.mutex.Unlock()
+	if h.retryable {
+		return &RetryableError{Err: fmt.Errorf("transient failure")}
+	}
+	return fmt.Errorf("permanent failure")
+}
+
+func (h *alwaysFailingHook) seenCalls() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out := make([]string, len(h.calls))
+	copy(out, h.calls)
+	return out
+}
+
+// countingBackOff wraps an ExponentialBackOff but additionally counts how
+// many times Reset and NextBackOff were called, so tests can observe retry
+// behavior that isn't otherwise visible from outside the package.
+type countingBackOff struct {
+	inner ExponentialBackOff
+
+	mutex        sync.Mutex
+	resets       int
+	nextBackOffs int
+}
+
+func (b *countingBackOff) NextBackOff() time.Duration {
+	b.mutex.Lock()
+	b.nextBackOffs++
+	b.mutex.Unlock()
+	return b.inner.NextBackOff()
+}
+
+func (b *countingBackOff) Reset() {
+	b.mutex.Lock()
+	b.resets++
+	b.mutex.Unlock()
+	b.inner.Reset()
+}
+
+func (b *countingBackOff) counts() (resets, nextBackOffs int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.resets, b.nextBackOffs
+}
+
+func TestTerminalErrorSkipsBackoffRetryLoop(t *testing.T) {
+	hook := &alwaysFailingHook{name: "terminal", retryable: false}
+	backoff := &countingBackOff{inner: ExponentialBackOff{
+		InitialInterval: 5 * time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		Multiplier:      1,
+	}}
+	data := NewHookData("terminal", EveryHash, 4)
+	runner := NewHookRunner(hook, backoff, data, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.Run(ctx)
+
+	runner.Send("h1")
+	runner.Send("h2")
+
+	deadline := time.After(5 * time.Second)
+	for {
+		if len(hook.seenCalls()) >= 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for both hashes to be attempted; calls so far: %v", hook.seenCalls())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if _, nextBackOffs := backoff.counts(); nextBackOffs != 0 {
+		t.Errorf("NextBackOff called %d times for a non-retryable error; want 0 (terminal failures should give up immediately)", nextBackOffs)
+	}
+}
+
+func TestCoalesceResetsBackoffOnHashChangeMidRetry(t *testing.T) {
+	hook := &alwaysFailingHook{name: "retryable", retryable: true}
+	backoff := &countingBackOff{inner: ExponentialBackOff{
+		InitialInterval: 20 * time.Millisecond,
+		MaxInterval:     20 * time.Millisecond,
+		Multiplier:      1,
+	}}
+	data := NewHookData("retryable", Coalesce, 0)
+	runner := NewHookRunner(hook, backoff, data, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.Run(ctx)
+
+	runner.Send("h1")
+	time.Sleep(5 * time.Millisecond) // let the runner fail once on h1 and start backing off
+	runner.Send("h2")                // arrives mid-backoff; should get a fresh budget, not h1's partly spent one
+
+	deadline := time.After(5 * time.Second)
+	for {
+		if resets, _ := backoff.counts(); resets >= 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			resets, _ := backoff.counts()
+			t.Fatalf("timed out waiting for a second backoff Reset after the hash changed mid-retry; got %d resets", resets)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestPerInvocationTimeoutAdvancesToNextHash(t *testing.T) {
+	hook := &blockingUntilCtxHook{name: "blocker"}
+	data := NewHookData("blocker", EveryHash, 4)
+	backoff := &ExponentialBackOff{
+		InitialInterval:     5 * time.Millisecond,
+		RandomizationFactor: 0,
+		Multiplier:          1,
+		MaxInterval:         5 * time.Millisecond,
+		MaxAttempts:         1,
+	}
+	runner := NewHookRunner(hook, backoff, data, nil, nil, 20*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.Run(ctx)
+
+	runner.Send("h1")
+	runner.Send("h2")
+
+	deadline := time.After(5 * time.Second)
+	for {
+		seenH2 := false
+		for _, c := range hook.seenCalls() {
+			if c == "h2" {
+				seenH2 = true
+				break
+			}
+		}
+		if seenH2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for h2 to be attempted after h1 timed out; calls so far: %v", hook.seenCalls())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestRunOnceReportsCancellationDistinctFromTerminal(t *testing.T) {
+	hook := &blockingUntilCtxHook{name: "blocker"}
+	data := NewHookData("blocker", EveryHash, 4)
+	runner := NewHookRunner(hook, nil, data, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // already canceled, as if Run's ctx were canceled for ordinary shutdown
+
+	if got := runner.runOnce(ctx, "h1"); got != runCanceled {
+		t.Errorf("runOnce on a canceled context = %v, want runCanceled", got)
+	}
+}
+
+func TestContextCancellationDoesNotGiveUpOrRetry(t *testing.T) {
+	hook := &blockingUntilCtxHook{name: "blocker"}
+	backoff := &countingBackOff{inner: ExponentialBackOff{
+		InitialInterval: 5 * time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		Multiplier:      1,
+	}}
+	data := NewHookData("blocker", EveryHash, 4)
+	runner := NewHookRunner(hook, backoff, data, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go runner.Run(ctx)
+
+	runner.Send("h1")
+
+	deadline := time.After(5 * time.Second)
+	for len(hook.seenCalls()) < 1 {
+		select {
+		case <-deadline:
+			t.Fatal("timed out waiting for the hook to be called")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel() // simulate ordinary shutdown while the hook is in flight
+
+	time.Sleep(50 * time.Millisecond) // give Run a chance to (mis)behave
+
+	if _, nextBackOffs := backoff.counts(); nextBackOffs != 0 {
+		t.Errorf("NextBackOff called %d times after context cancellation; want 0 (cancellation is not a retryable/terminal failure)", nextBackOffs)
+	}
+	if calls := len(hook.seenCalls()); calls != 1 {
+		t.Errorf("hook called %d times after cancellation; want 1 (the runner should stop instead of spinning on a canceled context)", calls)
+	}
+}
+
+// retryAfterHook fails its first call with a RetryableError carrying a
+// RetryAfter hint, then succeeds, so tests can observe how long HookRunner
+// waited in between.
+type retryAfterHook struct {
+	name       string
+	retryAfter time.Duration
+
+	mutex sync.Mutex
+	calls []time.Time
+}
+
+func (h *retryAfterHook) Name() string { return h.name }
+
+func (h *retryAfterHook) Do(ctx context.Context, hash string) error {
+	h.mutex.Lock()
+	h.calls = append(h.calls, time.Now())
+	n := len(h.calls)
+	h.mutex.Unlock()
+	if n == 1 {
+		return &RetryableError{Err: fmt.Errorf("try again"), RetryAfter: h.retryAfter}
+	}
+	return nil
+}
+
+func (h *retryAfterHook) callTimes() []time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out := make([]time.Time, len(h.calls))
+	copy(out, h.calls)
+	return out
+}
+
+func TestRetryAfterHintIsCappedByBackoffMaxWait(t *testing.T) {
+	hook := &retryAfterHook{name: "retry-after", retryAfter: 2 * time.Second}
+	backoff := &ExponentialBackOff{
+		InitialInterval: 5 * time.Millisecond,
+		MaxInterval:     80 * time.Millisecond,
+		Multiplier:      1,
+	}
+	data := NewHookData("retry-after", EveryHash, 4)
+	runner := NewHookRunner(hook, backoff, data, nil, nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.Run(ctx)
+
+	runner.Send("h1")
+
+	deadline := time.After(5 * time.Second)
+	for len(hook.callTimes()) < 2 {
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for the second attempt; calls so far: %d", len(hook.callTimes()))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	calls := hook.callTimes()
+	elapsed := calls[1].Sub(calls[0])
+	if elapsed < 40*time.Millisecond {
+		t.Errorf("retry happened after %v; want it lengthened toward the RetryAfter hint (2s), not the plain ~5ms backoff interval", elapsed)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("retry happened after %v; want it capped near the backoff's MaxInterval (80ms), not the full 2s RetryAfter hint", elapsed)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2021 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/git-sync/pkg/logging"
+)
+
+var (
+	hookLastSuccessTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_sync_hook_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful hook run, partitioned by name",
+	}, []string{"name"})
+)
+
+// depPollInterval is how often a dependent hook checks whether its parent
+// has completed the hash it is waiting on.
+const depPollInterval = 50 * time.Millisecond
+
+// HookSpec describes one hook to be dispatched by a HookManager.
+type HookSpec struct {
+	// Hook is the hook implementation to run.
+	Hook Hook
+	// Backoff controls retry behavior for this hook.  If nil,
+	// NewHookRunner's default is used.
+	Backoff BackOff
+	// DependsOn, if non-empty, must name another Hook in the same
+	// HookManager.  This hook will not run for a given hash until the named
+	// hook has completed successfully for that same hash.
+	DependsOn string
+	// Required marks this hook as one that HookManager.WaitForCompletion
+	// waits on.
+	Required bool
+	// Timeout bounds each individual call to this hook.  Zero means no
+	// per-call timeout.
+	Timeout time.Duration
+}
+
+// managedHook tracks per-hook state needed to fan out and, where
+// applicable, chain hooks together.
+type managedHook struct {
+	spec   HookSpec
+	runner *HookRunner
+
+	mutex sync.Mutex
+	// completedHash is the most recent hash this hook completed
+	// successfully, if any.  completedVersion is a monotonic counter
+	// incremented every time completedHash is updated, so dependents can
+	// detect "the parent has completed something new" without needing
+	// completedHash to match a specific value they have in hand -- the
+	// parent runs in Coalesce mode by default and may jump straight to the
+	// newest hash, skipping ones a dependent already captured.
+	completedHash    string
+	completedVersion uint64
+	firstSuccess     chan struct{}
+	closeOnce        sync.Once
+}
+
+// snapshot returns the most recently completed hash and the version it was
+// recorded at.
+func (mh *managedHook) snapshot() (hash string, version uint64) {
+	mh.mutex.Lock()
+	defer mh.mutex.Unlock()
+	return mh.completedHash, mh.completedVersion
+}
+
+func (mh *managedHook) markCompleted(hash string) {
+	mh.mutex.Lock()
+	mh.completedHash = hash
+	mh.completedVersion++
+	mh.mutex.Unlock()
+
+	mh.closeOnce.Do(func() { close(mh.firstSuccess) })
+}
+
+// HookManager fans a single sync event out to any number of hooks, chaining
+// dependent hooks so a dependent only fires once its parent has succeeded on
+// the same hash.
+type HookManager struct {
+	logger *logging.Logger
+
+	hooks map[string]*managedHook
+	order []string // insertion order, for deterministic iteration
+}
+
+// NewHookManager validates specs and returns a HookManager for them.  Hook
+// names (Hook.Name()) must be unique, and DependsOn must reference another
+// name present in specs.
+func NewHookManager(log *logging.Logger, specs ...HookSpec) (*HookManager, error) {
+	m := &HookManager{logger: log, hooks: map[string]*managedHook{}}
+
+	for _, spec := range specs {
+		name := spec.Hook.Name()
+		if _, exists := m.hooks[name]; exists {
+			return nil, fmt.Errorf("duplicate hook name %q", name)
+		}
+		m.hooks[name] = &managedHook{spec: spec, firstSuccess: make(chan struct{})}
+		m.order = append(m.order, name)
+	}
+
+	for _, name := range m.order {
+		dep := m.hooks[name].spec.DependsOn
+		if dep == "" {
+			continue
+		}
+		if dep == name {
+			return nil, fmt.Errorf("hook %q cannot depend on itself", name)
+		}
+		if _, exists := m.hooks[dep]; !exists {
+			return nil, fmt.Errorf("hook %q depends on unknown hook %q", name, dep)
+		}
+	}
+
+	for _, name := range m.order {
+		if cycle := m.dependencyCycleFrom(name); cycle != nil {
+			return nil, fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	return m, nil
+}
+
+// dependencyCycleFrom walks the DependsOn chain starting at name and
+// returns the cycle (as a chain of hook names ending back at its start) if
+// one is reachable, or nil if the chain terminates.
+func (m *HookManager) dependencyCycleFrom(name string) []string {
+	visited := map[string]bool{}
+	var chain []string
+	for cur := name; cur != ""; cur = m.hooks[cur].spec.DependsOn {
+		if visited[cur] {
+			return append(chain, cur)
+		}
+		visited[cur] = true
+		chain = append(chain, cur)
+	}
+	return nil
+}
+
+// Run starts a goroutine per hook and returns immediately.  A goroutine
+// returns once a hook call reports that ctx was canceled; ctx being done
+// does not by itself wake a goroutine that is idle waiting for a Send.
+func (m *HookManager) Run(ctx context.Context) {
+	registerHookMetricsOnce.Do(registerHookMetrics)
+
+	for _, name := range m.order {
+		mh := m.hooks[name]
+		wrapped := &gatedHook{inner: mh.spec.Hook, manager: m, dependsOn: mh.spec.DependsOn}
+		mh.runner = NewHookRunner(wrapped, mh.spec.Backoff, NewHookData(name, Coalesce, 0), m.logger, nil, mh.spec.Timeout)
+		go mh.runner.Run(ctx)
+	}
+}
+
+// Send fans hash out to every hook managed by m.  Hooks with a DependsOn
+// still receive the Send immediately; they internally wait until their
+// parent completes a hash it had not completed before, then invoke the
+// underlying hook with the parent's latest completed hash, which may be
+// newer than the one sent.
+//
+// Run must be called before Send: each hook's runner is only created there.
+// Calling Send first is a no-op (the hash is dropped rather than panicking),
+// since a caller racing Run and Send has no hook running yet to receive it
+// anyway.
+func (m *HookManager) Send(hash string) {
+	for _, name := range m.order {
+		if runner := m.hooks[name].runner; runner != nil {
+			runner.Send(hash)
+		}
+	}
+}
+
+// WaitForCompletion blocks until every Required hook has completed
+// successfully at least once, or until ctx is done.  Errors for hooks that
+// have not yet completed when ctx is done are reported together via a
+// wrapped error.
+func (m *HookManager) WaitForCompletion(ctx context.Context) error {
+	var required []string
+	for _, name := range m.order {
+		if m.hooks[name].spec.Required {
+			required = append(required, name)
+		}
+	}
+	if len(required) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(required))
+	for _, name := range required {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			select {
+			case <-m.hooks[name].firstSuccess:
+			case <-ctx.Done():
+				errCh <- fmt.Errorf("hook %q: %w", name, ctx.Err())
+			}
+		}(name)
+	}
+	wg.Wait()
+	close(errCh)
+
+	var errs []error
+	for err := range errCh {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("waiting for required hooks to complete: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// gatedHook wraps a Hook so that, if it depends on another hook, it blocks
+// until the parent has completed something new, then records its own
+// completion for any hooks that depend on it in turn.
+//
+// A gatedHook is only ever driven by its own HookRunner's single Run
+// goroutine, so lastParentVersion needs no synchronization of its own.
+type gatedHook struct {
+	inner     Hook
+	manager   *HookManager
+	dependsOn string
+
+	lastParentVersion uint64
+}
+
+func (g *gatedHook) Name() string { return g.inner.Name() }
+
+func (g *gatedHook) Do(ctx context.Context, hash string) error {
+	if g.dependsOn != "" {
+		parent := g.manager.hooks[g.dependsOn]
+		ticker := time.NewTicker(depPollInterval)
+		defer ticker.Stop()
+
+		var parentHash string
+		var version uint64
+		for {
+			parentHash, version = parent.snapshot()
+			if version > g.lastParentVersion {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+
+		// Re-target to whatever the parent most recently completed: the
+		// parent may have coalesced past the exact hash we were dequeued
+		// with, and waiting for that exact value to reappear would block
+		// forever.
+		g.lastParentVersion = version
+		hash = parentHash
+	}
+
+	if err := g.inner.Do(ctx, hash); err != nil {
+		return err
+	}
+
+	mh := g.manager.hooks[g.Name()]
+	mh.markCompleted(hash)
+	return nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2021 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hook
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHook records the hashes it was called with, in call order, and
+// always succeeds.
+type recordingHook struct {
+	name string
+
+	mutex  sync.Mutex
+	hashes []string
+}
+
+func (h *recordingHook) Name() string { return h.name }
+
+func (h *recordingHook) Do(ctx context.Context, hash string) error {
+	h.mutex.Lock()
+	h.hashes = append(h.hashes, hash)
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *recordingHook) seen() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out := make([]string, len(h.hashes))
+	copy(out, h.hashes)
+	return out
+}
+
+func TestHookManagerDependentWaitsForParent(t *testing.T) {
+	parent := &recordingHook{name: "parent"}
+	child := &recordingHook{name: "child"}
+
+	m, err := NewHookManager(nil,
+		HookSpec{Hook: parent, Required: true},
+		HookSpec{Hook: child, DependsOn: "parent", Required: true},
+	)
+	if err != nil {
+		t.Fatalf("NewHookManager: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Run(ctx)
+	m.Send("deadbeef")
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if err := m.WaitForCompletion(waitCtx); err != nil {
+		t.Fatalf("WaitForCompletion: %v", err)
+	}
+
+	if got := child.seen(); len(got) == 0 || got[0] != "deadbeef" {
+		t.Errorf("child hook did not observe hash: got %v", got)
+	}
+}
+
+func TestHookManagerDuplicateNameRejected(t *testing.T) {
+	a := &recordingHook{name: "dup"}
+	b := &recordingHook{name: "dup"}
+
+	if _, err := NewHookManager(nil,
+		HookSpec{Hook: a}, HookSpec{Hook: b}); err == nil {
+		t.Fatal("expected error for duplicate hook names, got nil")
+	}
+}
+
+func TestHookManagerUnknownDependencyRejected(t *testing.T) {
+	a := &recordingHook{name: "a"}
+
+	if _, err := NewHookManager(nil,
+		HookSpec{Hook: a, DependsOn: "nope"}); err == nil {
+		t.Fatal("expected error for unknown DependsOn, got nil")
+	}
+}
+
+func TestHookManagerDependencyCycleRejected(t *testing.T) {
+	a := &recordingHook{name: "a"}
+	b := &recordingHook{name: "b"}
+
+	if _, err := NewHookManager(nil,
+		HookSpec{Hook: a, DependsOn: "b"},
+		HookSpec{Hook: b, DependsOn: "a"},
+	); err == nil {
+		t.Fatal("expected error for a dependency cycle, got nil")
+	}
+}
+
+func TestHookManagerSendBeforeRunIsANoOp(t *testing.T) {
+	a := &recordingHook{name: "a"}
+
+	m, err := NewHookManager(nil, HookSpec{Hook: a})
+	if err != nil {
+		t.Fatalf("NewHookManager: %v", err)
+	}
+
+	// Run was never called, so no runner exists yet; Send must not panic.
+	m.Send("deadbeef")
+}
+
+func TestHookManagerWaitForCompletionTimesOut(t *testing.T) {
+	// A hook that never completes (blocks on ctx.Done()).
+	blocking := &blockingHook{name: "blocking"}
+
+	m, err := NewHookManager(nil,
+		HookSpec{Hook: blocking, Required: true})
+	if err != nil {
+		t.Fatalf("NewHookManager: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Run(ctx)
+	m.Send("deadbeef")
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer waitCancel()
+	if err := m.WaitForCompletion(waitCtx); err == nil {
+		t.Fatal("expected WaitForCompletion to time out, got nil error")
+	}
+}
+
+type blockingHook struct{ name string }
+
+func (h *blockingHook) Name() string { return h.name }
+func (h *blockingHook) Do(ctx context.Context, hash string) error {
+	<-ctx.Done()
+	return nil
+}
+
+// TestGatedHookRetargetsPastCoalescedHash reproduces the race from two rapid
+// Sends that a Manager-level test can't force deterministically: the parent
+// runs in Coalesce mode and may skip straight from an idle state to the
+// newest hash without ever completing the one its dependent already
+// captured. A dependent waiting on that exact hash value would block
+// forever; it must instead notice the parent has completed *something new*
+// and re-target to that.
+func TestGatedHookRetargetsPastCoalescedHash(t *testing.T) {
+	m := &HookManager{hooks: map[string]*managedHook{}}
+	m.hooks["parent"] = &managedHook{firstSuccess: make(chan struct{})}
+	m.hooks["child"] = &managedHook{firstSuccess: make(chan struct{})}
+
+	childInner := &recordingHook{name: "child"}
+	child := &gatedHook{inner: childInner, manager: m, dependsOn: "parent"}
+
+	done := make(chan error, 1)
+	go func() {
+		// The dependent was dequeued with "h1" ...
+		done <- child.Do(context.Background(), "h1")
+	}()
+
+	// Give the goroutine a moment to reach the wait loop.
+	deadlineStart := time.Now()
+	for {
+		select {
+		case err := <-done:
+			t.Fatalf("child.Do returned early (err=%v) before the parent completed anything", err)
+		default:
+		}
+		if time.Since(deadlineStart) > 20*time.Millisecond {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// ... but the parent, running in Coalesce mode, never completes "h1" --
+	// it jumps straight to "h2".
+	m.hooks["parent"].markCompleted("h2")
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("child.Do: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("child.Do never unblocked after the parent completed a newer hash; looks deadlocked")
+	}
+
+	if got := childInner.seen(); len(got) != 1 || got[0] != "h2" {
+		t.Errorf("child ran with hashes %v, want it re-targeted to the parent's latest completed hash h2", got)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2021 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook provides a hook.Hook implementation that delivers sync
+// events as signed HTTP POST requests, letting git-sync plug directly into
+// webhook-consuming infrastructure instead of shelling out to curl via
+// exechook.
+//
+// Callers build an Options (typically from their own flag parsing) and pass
+// it to New.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"k8s.io/git-sync/pkg/hook"
+)
+
+var _ hook.Hook = (*Hook)(nil)
+
+// Options configures a webhook Hook.
+type Options struct {
+	// URL is the endpoint to POST to.  Required.
+	URL string
+	// Method is the HTTP method to use.  Defaults to POST.
+	Method string
+	// Timeout bounds each individual delivery attempt.  Zero means no
+	// per-request timeout beyond whatever the caller's context imposes.
+	Timeout time.Duration
+	// Headers are added to every request, in addition to the ones this
+	// package sets itself (Content-Type, X-GitSync-*).
+	Headers http.Header
+	// Secret, if non-empty, is used to HMAC-SHA256 sign the request body.
+	// Callers typically read this from a file (--webhook-secret-file) so it
+	// never appears on the command line.
+	Secret []byte
+	// Repo and Ref are included verbatim in the delivered payload.
+	Repo string
+	Ref  string
+}
+
+// Hook is a hook.Hook that delivers sync events over HTTP.
+type Hook struct {
+	opts   Options
+	client *http.Client
+
+	mutex    sync.Mutex
+	lastHash string
+	attempt  int
+}
+
+// New returns a Hook for the given Options.  URL must be set.
+func New(opts Options) (*Hook, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("webhook: URL is required")
+	}
+	if opts.Method == "" {
+		opts.Method = http.MethodPost
+	}
+	return &Hook{
+		opts:   opts,
+		client: &http.Client{},
+	}, nil
+}
+
+// Name implements hook.Hook.
+func (h *Hook) Name() string {
+	return "webhook"
+}
+
+// payload is the JSON body delivered to the webhook endpoint.
+type payload struct {
+	Repo     string    `json:"repo"`
+	Ref      string    `json:"ref"`
+	Hash     string    `json:"hash"`
+	SyncTime time.Time `json:"sync_time"`
+	Attempt  int       `json:"attempt"`
+}
+
+// Do implements hook.Hook.  It POSTs the sync event as a signed JSON body,
+// respecting Options.Timeout for the request itself, and reports a
+// retryable error back to the caller's backoff loop for 5xx/408/429
+// responses.  It never sleeps itself: a Retry-After header is parsed and
+// carried on the returned RetryableError as a hint for HookRunner's backoff
+// policy, which still owns how long to actually wait and keeps that wait
+// capped, so a slow or malicious endpoint can't stall the hook pipeline by
+// returning an arbitrarily large Retry-After.
+func (h *Hook) Do(ctx context.Context, hash string) error {
+	attempt := h.nextAttempt(hash)
+
+	body, err := json.Marshal(payload{
+		Repo:     h.opts.Repo,
+		Ref:      h.opts.Ref,
+		Hash:     hash,
+		SyncTime: time.Now().UTC(),
+		Attempt:  attempt,
+	})
+	if err != nil {
+		return fmt.Errorf("webhook: marshaling payload: %w", err)
+	}
+
+	reqCtx := ctx
+	if h.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, h.opts.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, h.opts.Method, h.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook: building request: %w", err)
+	}
+	h.setHeaders(req, body)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return &hook.RetryableError{Err: fmt.Errorf("webhook: delivering request: %w", err)}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	if retryable {
+		wait, _ := retryAfter(resp.Header.Get("Retry-After"))
+		return &hook.RetryableError{Err: fmt.Errorf("webhook: server returned %s", resp.Status), RetryAfter: wait}
+	}
+
+	return fmt.Errorf("webhook: server returned %s", resp.Status)
+}
+
+// setHeaders populates the caller-supplied headers plus this package's own
+// delivery metadata and, if a secret is configured, an HMAC-SHA256 signature
+// of the request body.
+func (h *Hook) setHeaders(req *http.Request, body []byte) {
+	for k, vs := range h.opts.Headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitSync-Delivery", uuid.NewString())
+	req.Header.Set("X-GitSync-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+
+	if len(h.opts.Secret) > 0 {
+		mac := hmac.New(sha256.New, h.opts.Secret)
+		mac.Write(body)
+		req.Header.Set("X-GitSync-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// nextAttempt returns the 1-based attempt number for hash, resetting the
+// counter whenever hash changes from the last call.
+func (h *Hook) nextAttempt(hash string) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if hash != h.lastHash {
+		h.lastHash = hash
+		h.attempt = 0
+	}
+	h.attempt++
+	return h.attempt
+}
+
+// retryAfter parses a Retry-After header value, which per RFC 9110 may be
+// either a number of seconds or an HTTP-date.  Only the seconds form is
+// supported; an HTTP-date value is ignored (ok is false), and the resulting
+// hook.RetryableError.RetryAfter is left at zero so HookRunner's backoff
+// policy falls back to its own interval.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2021 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/git-sync/pkg/hook"
+)
+
+func TestDoSuccessSignsPayload(t *testing.T) {
+	secret := []byte("s3cr3t")
+	var gotBody []byte
+	var gotSig string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = io.ReadAll(r.Body)
+		gotSig = r.Header.Get("X-GitSync-Signature")
+		if r.Header.Get("X-GitSync-Delivery") == "" {
+			t.Error("missing X-GitSync-Delivery header")
+		}
+		if r.Header.Get("X-GitSync-Timestamp") == "" {
+			t.Error("missing X-GitSync-Timestamp header")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	h, err := New(Options{URL: srv.URL, Secret: secret, Repo: "r", Ref: "main"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := h.Do(context.Background(), "deadbeef"); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(gotBody)
+	wantSig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if gotSig != wantSig {
+		t.Errorf("signature mismatch: got %q, want %q", gotSig, wantSig)
+	}
+
+	var p payload
+	if err := json.Unmarshal(gotBody, &p); err != nil {
+		t.Fatalf("unmarshaling body: %v", err)
+	}
+	if p.Hash != "deadbeef" || p.Repo != "r" || p.Ref != "main" || p.Attempt != 1 {
+		t.Errorf("unexpected payload: %+v", p)
+	}
+}
+
+func TestDoRetryable5xx(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	h, err := New(Options{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	err = h.Do(context.Background(), "deadbeef")
+	if err == nil {
+		t.Fatal("expected error for 502 response")
+	}
+	var re *hook.RetryableError
+	if !errors.As(err, &re) {
+		t.Errorf("expected a retryable error, got %v (%T)", err, err)
+	}
+}
+
+func TestDoDoesNotBlockOnRetryAfter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	h, err := New(Options{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	start := time.Now()
+	err = h.Do(context.Background(), "deadbeef")
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Do took %v for a 429 with Retry-After: 2; want it to return immediately and let the backoff policy own the wait", elapsed)
+	}
+	var re *hook.RetryableError
+	if !errors.As(err, &re) {
+		t.Errorf("expected a retryable error, got %v (%T)", err, err)
+	} else if re.RetryAfter != 2*time.Second {
+		t.Errorf("RetryAfter = %v, want 2s (parsed from the Retry-After header)", re.RetryAfter)
+	}
+}
+
+func TestDoNonRetryable4xx(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	h, err := New(Options{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	err = h.Do(context.Background(), "deadbeef")
+	if err == nil {
+		t.Fatal("expected error for 400 response")
+	}
+	var re *hook.RetryableError
+	if errors.As(err, &re) {
+		t.Errorf("expected a non-retryable error, got %v (%T)", err, err)
+	}
+}
+
+func TestAttemptResetsOnNewHash(t *testing.T) {
+	h, err := New(Options{URL: "http://example.invalid"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if got := h.nextAttempt("a"); got != 1 {
+		t.Errorf("first attempt for hash a: got %d, want 1", got)
+	}
+	if got := h.nextAttempt("a"); got != 2 {
+		t.Errorf("second attempt for hash a: got %d, want 2", got)
+	}
+	if got := h.nextAttempt("b"); got != 1 {
+		t.Errorf("first attempt for hash b: got %d, want 1", got)
+	}
+}